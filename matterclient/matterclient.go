@@ -1,23 +1,38 @@
 package matterclient
 
 import (
+	"crypto/md5"
+	"crypto/tls"
 	"errors"
-	"log"
+	"fmt"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
+	"github.com/hashicorp/golang-lru"
 	"github.com/jpillora/backoff"
 	"github.com/mattermost/platform/model"
+	"golang.org/x/sync/singleflight"
 )
 
+// default size of the LRU dedupe cache when Credentials.MessageCacheSize is unset.
+const messageCacheSize = 500
+
 type Credentials struct {
-	Login  string
-	Team   string
-	Pass   string
-	Server string
-	NoTLS  bool
+	Login            string
+	Team             string
+	Pass             string
+	Server           string
+	NoTLS            bool
+	MessageCacheSize int
+	Token            string
+	CookieToken      bool
+	SkipTLSVerify    bool
 }
 
 type Message struct {
@@ -27,6 +42,16 @@ type Message struct {
 	Channel  string
 	Username string
 	Text     string
+	Type     string
+}
+
+// Team holds one joined team's channels and users, plus a client scoped to it.
+type Team struct {
+	Team         *model.Team
+	Channels     *model.ChannelList
+	MoreChannels *model.ChannelList
+	Users        map[string]*model.User
+	Client       *model.Client
 }
 
 type MMClient struct {
@@ -39,15 +64,38 @@ type MMClient struct {
 	Users        map[string]*model.User
 	MessageChan  chan *Message
 	Team         *model.Team
+	OtherTeams   []*Team
+	lruCache     *lru.Cache
+
+	// mutex guards Users, Channels, MoreChannels, OtherTeams, Team and User
+	mutex       sync.RWMutex
+	userRefresh singleflight.Group
+
+	logger *logrus.Entry
 }
 
 func New(login, pass, team, server string) *MMClient {
 	cred := &Credentials{Login: login, Pass: pass, Team: team, Server: server}
 	mmclient := &MMClient{Credentials: cred, MessageChan: make(chan *Message, 100)}
+	mmclient.logger = logrus.WithFields(logrus.Fields{"module": "matterclient"})
 	return mmclient
 }
 
+func (m *MMClient) SetLogger(logger *logrus.Entry) {
+	m.logger = logger
+}
+
 func (m *MMClient) Login() error {
+	// built lazily here (not in New) so a caller's MessageCacheSize takes
+	// effect, and only once so the dedupe cache survives reconnects.
+	if m.lruCache == nil {
+		size := m.Credentials.MessageCacheSize
+		if size == 0 {
+			size = messageCacheSize
+		}
+		m.lruCache, _ = lru.New(size)
+	}
+
 	b := &backoff.Backoff{
 		Min:    time.Second,
 		Max:    5 * time.Minute,
@@ -61,41 +109,67 @@ func (m *MMClient) Login() error {
 	}
 	// login to mattermost
 	m.Client = model.NewClient(uriScheme + m.Credentials.Server)
-	var myinfo *model.Result
-	var appErr *model.AppError
-	for {
-		log.Println("retrying login", m.Credentials.Team, m.Credentials.Login, m.Credentials.Server)
-		myinfo, appErr = m.Client.LoginByEmail(m.Credentials.Team, m.Credentials.Login, m.Credentials.Pass)
-		if appErr != nil {
-			d := b.Duration()
-			if !strings.Contains(appErr.DetailedError, "connection refused") &&
-				!strings.Contains(appErr.DetailedError, "invalid character") {
-				return errors.New(appErr.Message)
+	if m.Credentials.SkipTLSVerify {
+		m.Client.HttpClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+	if m.Credentials.Token != "" {
+		if err := m.doLoginToken(); err != nil {
+			return err
+		}
+	} else {
+		var myinfo *model.Result
+		var appErr *model.AppError
+		for {
+			m.logger.Debugf("retrying login %s %s %s", m.Credentials.Team, m.Credentials.Login, m.Credentials.Server)
+			myinfo, appErr = m.Client.LoginByEmail(m.Credentials.Team, m.Credentials.Login, m.Credentials.Pass)
+			if appErr != nil {
+				d := b.Duration()
+				if !strings.Contains(appErr.DetailedError, "connection refused") &&
+					!strings.Contains(appErr.DetailedError, "invalid character") {
+					return errors.New(appErr.Message)
+				}
+				m.logger.Debugf("LOGIN: %s, reconnecting in %s", appErr, d)
+				time.Sleep(d)
+				continue
 			}
-			log.Printf("LOGIN: %s, reconnecting in %s", appErr, d)
-			time.Sleep(d)
-			continue
+			break
 		}
-		break
+		m.mutex.Lock()
+		m.User = myinfo.Data.(*model.User)
+		m.mutex.Unlock()
 	}
 	// reset timer
 	b.Reset()
-	m.User = myinfo.Data.(*model.User)
-	myinfo, _ = m.Client.GetMyTeam("")
+	myinfo, _ := m.Client.GetMyTeam("")
+	m.mutex.Lock()
 	m.Team = myinfo.Data.(*model.Team)
+	m.mutex.Unlock()
 
 	// setup websocket connection
 	wsurl := wsScheme + m.Credentials.Server + "/api/v1/websocket"
 	header := http.Header{}
 	header.Set(model.HEADER_AUTH, "BEARER "+m.Client.AuthToken)
 
+	dialer := websocket.DefaultDialer
+	if m.Credentials.SkipTLSVerify || m.Credentials.CookieToken {
+		dialer = &websocket.Dialer{}
+		if m.Credentials.SkipTLSVerify {
+			dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		if m.Credentials.CookieToken {
+			dialer.Jar = m.Client.HttpClient.Jar
+		}
+	}
+
 	var WsClient *websocket.Conn
 	var err error
 	for {
-		WsClient, _, err = websocket.DefaultDialer.Dial(wsurl, header)
+		WsClient, _, err = dialer.Dial(wsurl, header)
 		if err != nil {
 			d := b.Duration()
-			log.Printf("WSS: %s, reconnecting in %s", err, d)
+			m.logger.Debugf("WSS: %s, reconnecting in %s", err, d)
 			time.Sleep(d)
 			continue
 		}
@@ -111,6 +185,88 @@ func (m *MMClient) Login() error {
 	// populating channels
 	m.UpdateChannels()
 
+	// populating any other teams the bot user has joined
+	m.UpdateTeams()
+
+	return nil
+}
+
+func (m *MMClient) UpdateTeams() error {
+	teams, err := m.Client.GetAllTeamListings()
+	if err != nil {
+		return err
+	}
+	m.mutex.RLock()
+	primaryTeamId := m.Team.Id
+	m.mutex.RUnlock()
+
+	var otherTeams []*Team
+	for _, t := range teams.Data.(map[string]*model.Team) {
+		if t.Id == primaryTeamId {
+			continue
+		}
+		// own client scoped to t.Id, so we never flip the active team on
+		// the shared m.Client and race other goroutines using it
+		teamClient := *m.Client
+		teamClient.SetTeamId(t.Id)
+		mmusers, _ := teamClient.GetProfiles(t.Id, "")
+		mmchannels, _ := teamClient.GetChannels("")
+		mmmorechannels, _ := teamClient.GetMoreChannels("")
+		otherTeams = append(otherTeams, &Team{
+			Team:         t,
+			Users:        mmusers.Data.(map[string]*model.User),
+			Channels:     mmchannels.Data.(*model.ChannelList),
+			MoreChannels: mmmorechannels.Data.(*model.ChannelList),
+			Client:       &teamClient,
+		})
+	}
+	m.mutex.Lock()
+	m.OtherTeams = otherTeams
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *MMClient) doLoginToken() error {
+	m.Client.AuthType = model.HEADER_BEARER
+	m.Client.AuthToken = m.Credentials.Token
+
+	if m.Credentials.CookieToken {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return err
+		}
+		u, err := url.Parse(m.Client.Url)
+		if err != nil {
+			return err
+		}
+		jar.SetCookies(u, []*http.Cookie{{Name: "MMAUTHTOKEN", Value: m.Credentials.Token}})
+		m.Client.HttpClient.Jar = jar
+	}
+
+	b := &backoff.Backoff{
+		Min:    time.Second,
+		Max:    5 * time.Minute,
+		Jitter: true,
+	}
+	var myinfo *model.Result
+	var appErr *model.AppError
+	for {
+		myinfo, appErr = m.Client.GetMe("")
+		if appErr != nil {
+			d := b.Duration()
+			if !strings.Contains(appErr.DetailedError, "connection refused") &&
+				!strings.Contains(appErr.DetailedError, "invalid character") {
+				return errors.New(appErr.Message)
+			}
+			m.logger.Debugf("LOGIN: %s, reconnecting in %s", appErr, d)
+			time.Sleep(d)
+			continue
+		}
+		break
+	}
+	m.mutex.Lock()
+	m.User = myinfo.Data.(*model.User)
+	m.mutex.Unlock()
 	return nil
 }
 
@@ -118,7 +274,7 @@ func (m *MMClient) WsReceiver() {
 	var rmsg model.Message
 	for {
 		if err := m.WsClient.ReadJSON(&rmsg); err != nil {
-			log.Println("error:", err)
+			m.logger.Errorf("error: %s", err)
 			// reconnect
 			m.Login()
 		}
@@ -134,6 +290,10 @@ func (m *MMClient) parseMessage(rmsg *Message) {
 	switch rmsg.Raw.Action {
 	case model.ACTION_POSTED:
 		m.parseActionPost(rmsg)
+	case model.ACTION_POST_EDITED:
+		m.parseActionPostEdited(rmsg)
+	case model.ACTION_POST_DELETED:
+		m.parseActionPostDeleted(rmsg)
 		/*
 			case model.ACTION_USER_REMOVED:
 				m.handleWsActionUserRemoved(&rmsg)
@@ -144,52 +304,168 @@ func (m *MMClient) parseMessage(rmsg *Message) {
 }
 
 func (m *MMClient) parseActionPost(rmsg *Message) {
+	// websocket redelivers the same post on reconnects, so dedupe on the raw JSON
+	digest := fmt.Sprintf("%x", md5.Sum([]byte(rmsg.Raw.Props["post"])))
+	if _, ok := m.lruCache.Get(digest); ok {
+		rmsg.Text = ""
+		return
+	}
+	m.lruCache.Add(digest, nil)
+
+	data := model.PostFromJson(strings.NewReader(rmsg.Raw.Props["post"]))
+	m.resolvePost(rmsg, data)
+	rmsg.Type = "post"
+}
+
+func (m *MMClient) parseActionPostEdited(rmsg *Message) {
+	data := model.PostFromJson(strings.NewReader(rmsg.Raw.Props["post"]))
+	m.resolvePost(rmsg, data)
+	rmsg.Type = "edit"
+}
+
+func (m *MMClient) parseActionPostDeleted(rmsg *Message) {
 	data := model.PostFromJson(strings.NewReader(rmsg.Raw.Props["post"]))
+	m.resolvePost(rmsg, data)
+	rmsg.Type = "delete"
+}
+
+func (m *MMClient) resolvePost(rmsg *Message, data *model.Post) {
 	//	log.Println("receiving userid", data.UserId)
-	// we don't have the user, refresh the userlist
-	if m.Users[data.UserId] == nil {
-		m.UpdateUsers()
+	user := m.lookupUser(data.UserId)
+	if user == nil {
+		// unknown user, refresh all teams' rosters; singleflight collapses
+		// a burst of messages from the same new user into one refresh
+		m.userRefresh.Do("UpdateAllUsers", func() (interface{}, error) {
+			return nil, m.UpdateAllUsers()
+		})
+		user = m.lookupUser(data.UserId)
+	}
+	if user != nil {
+		rmsg.Username = user.Username
 	}
-	rmsg.Username = m.Users[data.UserId].Username
 	rmsg.Channel = m.GetChannelName(data.ChannelId)
 	// direct message
 	if strings.Contains(rmsg.Channel, "__") {
 		//log.Println("direct message")
 		rcvusers := strings.Split(rmsg.Channel, "__")
-		if rcvusers[0] != m.User.Id {
-			rmsg.Channel = m.Users[rcvusers[0]].Username
-		} else {
-			rmsg.Channel = m.Users[rcvusers[1]].Username
+		m.mutex.RLock()
+		myId := m.User.Id
+		m.mutex.RUnlock()
+		otherId := rcvusers[0]
+		if otherId == myId {
+			otherId = rcvusers[1]
+		}
+		if other := m.lookupUser(otherId); other != nil {
+			rmsg.Channel = other.Username
 		}
 	}
 	rmsg.Text = data.Message
 	rmsg.Post = data
-	return
+}
+
+func (m *MMClient) lookupUser(userId string) *model.User {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if user, ok := m.Users[userId]; ok {
+		return user
+	}
+	for _, t := range m.OtherTeams {
+		if user, ok := t.Users[userId]; ok {
+			return user
+		}
+	}
+	return nil
+}
+
+func (m *MMClient) UpdateAllUsers() error {
+	if err := m.UpdateUsers(); err != nil {
+		return err
+	}
+	m.mutex.RLock()
+	otherTeams := m.OtherTeams
+	m.mutex.RUnlock()
+	for _, t := range otherTeams {
+		mmusers, err := t.Client.GetProfiles(t.Team.Id, "")
+		if err != nil {
+			continue
+		}
+		m.mutex.Lock()
+		t.Users = mmusers.Data.(map[string]*model.User)
+		m.mutex.Unlock()
+	}
+	return nil
+}
+
+func (m *MMClient) clientForTeam(teamId string) *model.Client {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if teamId == "" || teamId == m.Team.Id {
+		return m.Client
+	}
+	for _, t := range m.OtherTeams {
+		if t.Team.Id == teamId {
+			return t.Client
+		}
+	}
+	return m.Client
 }
 
 func (m *MMClient) UpdateUsers() error {
-	mmusers, _ := m.Client.GetProfiles(m.User.TeamId, "")
+	m.mutex.RLock()
+	teamId := m.User.TeamId
+	m.mutex.RUnlock()
+	mmusers, _ := m.Client.GetProfiles(teamId, "")
+	m.mutex.Lock()
 	m.Users = mmusers.Data.(map[string]*model.User)
+	m.mutex.Unlock()
 	return nil
 }
 
 func (m *MMClient) UpdateChannels() error {
 	mmchannels, _ := m.Client.GetChannels("")
+	mmmorechannels, _ := m.Client.GetMoreChannels("")
+	m.mutex.Lock()
 	m.Channels = mmchannels.Data.(*model.ChannelList)
-	mmchannels, _ = m.Client.GetMoreChannels("")
-	m.MoreChannels = mmchannels.Data.(*model.ChannelList)
+	m.MoreChannels = mmmorechannels.Data.(*model.ChannelList)
+	m.mutex.Unlock()
 	return nil
 }
 
-func (m *MMClient) GetChannelName(id string) string {
-	for _, channel := range append(m.Channels.Channels, m.MoreChannels.Channels...) {
+func (m *MMClient) teamChannels(teamId string) []model.Channel {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var channels []model.Channel
+	if teamId == "" || teamId == m.Team.Id {
+		channels = append(channels, m.Channels.Channels...)
+		channels = append(channels, m.MoreChannels.Channels...)
+	}
+	for _, t := range m.OtherTeams {
+		if teamId != "" && t.Team.Id != teamId {
+			continue
+		}
+		channels = append(channels, t.Channels.Channels...)
+		channels = append(channels, t.MoreChannels.Channels...)
+	}
+	return channels
+}
+
+func teamIdArg(teamId []string) string {
+	if len(teamId) > 0 {
+		return teamId[0]
+	}
+	return ""
+}
+
+func (m *MMClient) GetChannelName(id string, teamId ...string) string {
+	tid := teamIdArg(teamId)
+	for _, channel := range m.teamChannels(tid) {
 		if channel.Id == id {
 			return channel.Name
 		}
 	}
 	// not found? could be a new direct message from mattermost. Try to update and check again
 	m.UpdateChannels()
-	for _, channel := range append(m.Channels.Channels, m.MoreChannels.Channels...) {
+	for _, channel := range m.teamChannels(tid) {
 		if channel.Id == id {
 			return channel.Name
 		}
@@ -197,8 +473,9 @@ func (m *MMClient) GetChannelName(id string) string {
 	return ""
 }
 
-func (m *MMClient) GetChannelId(name string) string {
-	for _, channel := range append(m.Channels.Channels, m.MoreChannels.Channels...) {
+func (m *MMClient) GetChannelId(name string, teamId ...string) string {
+	tid := teamIdArg(teamId)
+	for _, channel := range m.teamChannels(tid) {
 		if channel.Name == name {
 			return channel.Id
 		}
@@ -206,8 +483,9 @@ func (m *MMClient) GetChannelId(name string) string {
 	return ""
 }
 
-func (m *MMClient) GetChannelHeader(id string) string {
-	for _, channel := range append(m.Channels.Channels, m.MoreChannels.Channels...) {
+func (m *MMClient) GetChannelHeader(id string, teamId ...string) string {
+	tid := teamIdArg(teamId)
+	for _, channel := range m.teamChannels(tid) {
 		if channel.Id == id {
 			return channel.Header
 		}
@@ -215,16 +493,52 @@ func (m *MMClient) GetChannelHeader(id string) string {
 	return ""
 }
 
-func (m *MMClient) PostMessage(channel string, text string) {
-	post := &model.Post{ChannelId: m.GetChannelId(channel), Message: text}
-	m.Client.CreatePost(post)
+func (m *MMClient) GetTeamName(teamId string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.Team.Id == teamId {
+		return m.Team.Name
+	}
+	for _, t := range m.OtherTeams {
+		if t.Team.Id == teamId {
+			return t.Team.Name
+		}
+	}
+	return ""
+}
+
+func (m *MMClient) GetChannelTeamId(channelId string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	for _, channel := range append(m.Channels.Channels, m.MoreChannels.Channels...) {
+		if channel.Id == channelId {
+			return m.Team.Id
+		}
+	}
+	for _, t := range m.OtherTeams {
+		for _, channel := range append(t.Channels.Channels, t.MoreChannels.Channels...) {
+			if channel.Id == channelId {
+				return t.Team.Id
+			}
+		}
+	}
+	return ""
+}
+
+func (m *MMClient) PostMessage(channel string, text string, teamId ...string) {
+	tid := teamIdArg(teamId)
+	post := &model.Post{ChannelId: m.GetChannelId(channel, tid), Message: text}
+	m.clientForTeam(tid).CreatePost(post)
 }
 
-func (m *MMClient) JoinChannel(channel string) error {
-	if m.GetChannelId(strings.Replace(channel, "#", "", 1)) == "" {
+func (m *MMClient) JoinChannel(channel string, teamId ...string) error {
+	tid := teamIdArg(teamId)
+	channel = strings.Replace(channel, "#", "", 1)
+	channelId := m.GetChannelId(channel, tid)
+	if channelId == "" {
 		return errors.New("failed to join")
 	}
-	_, err := m.Client.JoinChannel(m.GetChannelId(strings.Replace(channel, "#", "", 1)))
+	_, err := m.clientForTeam(tid).JoinChannel(channelId)
 	if err != nil {
 		return errors.New("failed to join")
 	}
@@ -232,6 +546,23 @@ func (m *MMClient) JoinChannel(channel string) error {
 	return nil
 }
 
+func (m *MMClient) DeleteMessage(channelId, postId string) error {
+	_, err := m.Client.DeletePost(channelId, postId)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *MMClient) EditMessage(channelId, postId, text string) error {
+	post := &model.Post{Id: postId, ChannelId: channelId, Message: text}
+	_, err := m.Client.UpdatePost(post)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func (m *MMClient) GetPostsSince(channelId string, time int64) *model.PostList {
 	res, err := m.Client.GetPostsSince(channelId, time)
 	if err != nil {
@@ -260,17 +591,17 @@ func (m *MMClient) UpdateChannelHeader(channelId string, header string) {
 	data := make(map[string]string)
 	data["channel_id"] = channelId
 	data["channel_header"] = header
-	log.Printf("updating channelheader %#v, %#v", channelId, header)
+	m.logger.Debugf("updating channelheader %#v, %#v", channelId, header)
 	_, err := m.Client.UpdateChannelHeader(data)
 	if err != nil {
-		log.Print(err)
+		m.logger.Error(err)
 	}
 }
 
 func (m *MMClient) UpdateLastViewed(channelId string) {
-	log.Printf("posting lastview %#v", channelId)
+	m.logger.Debugf("posting lastview %#v", channelId)
 	_, err := m.Client.UpdateLastViewedAt(channelId)
 	if err != nil {
-		log.Print(err)
+		m.logger.Error(err)
 	}
 }